@@ -0,0 +1,421 @@
+package matrixdll
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"maunium.net/go/mautrix/event"
+)
+
+// CallState tracks where a 1:1 call is in the MSC2746 signaling lifecycle.
+type CallState int
+
+const (
+	CallStateIdle CallState = iota
+	CallStateInviteSent
+	CallStateRinging
+	CallStateConnecting
+	CallStateConnected
+	CallStateEnded
+)
+
+// CallListener receives call lifecycle events. Implementations are driven
+// from the mautrix sync loop, so methods must not block. The interface is
+// kept to primitive types so it can be bound via golang.org/x/mobile/bind.
+type CallListener interface {
+	OnIncomingCall(callID string)
+	OnCallEnded(callID string, reason string)
+	OnRemoteHangup(callID string, reason string)
+}
+
+// SetCallListener registers the callback interface used to drive a mobile
+// binding's UI from call signaling events. Call it before StartCall.
+func (c *Client) SetCallListener(l CallListener) {
+	c.listener = l
+}
+
+// Answer accepts the currently ringing call identified by callID, sending
+// an m.call.answer event with our local SDP.
+func (c *Client) Answer(callID string) error {
+	c.mu.Lock()
+	if c.callState != CallStateRinging || c.currentCallID != callID {
+		c.mu.Unlock()
+		return fmt.Errorf("no ringing call with id %s", callID)
+	}
+	c.stopInviteTimerLocked()
+	c.callState = CallStateConnecting
+	c.mu.Unlock()
+
+	ans, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("CreateAnswer error: %w", err)
+	}
+	if err := c.pc.SetLocalDescription(ans); err != nil {
+		return fmt.Errorf("SetLocalDescription error: %w", err)
+	}
+	// Candidates trickle separately via pc.OnICECandidate; don't block on
+	// full ICE gathering before answering.
+
+	payload := map[string]interface{}{
+		"call_id":  callID,
+		"party_id": c.myPartyID,
+		"version":  "1",
+		"answer":   map[string]interface{}{"type": "answer", "sdp": ans.SDP},
+	}
+	return c.sendCallEvent(context.Background(), event.CallAnswer, payload)
+}
+
+// Reject declines the currently ringing call with an m.call.reject event.
+func (c *Client) Reject() error {
+	c.mu.Lock()
+	if c.callState != CallStateRinging {
+		c.mu.Unlock()
+		return fmt.Errorf("no ringing call to reject")
+	}
+	callID := c.currentCallID
+	c.stopInviteTimerLocked()
+	c.callState = CallStateEnded
+	c.mu.Unlock()
+	return c.sendReject(callID)
+}
+
+// Hangup ends the current call (whatever its state) with an m.call.hangup
+// event carrying the given reason, e.g. "user_hangup" or "ice_failed". The
+// call's local track and its encode goroutine/runStatsLoop are torn down
+// immediately rather than left running until the next StartCall.
+func (c *Client) Hangup(reason string) error {
+	c.mu.Lock()
+	if c.callState == CallStateIdle || c.callState == CallStateEnded {
+		c.mu.Unlock()
+		return fmt.Errorf("no active call to hang up")
+	}
+	callID := c.currentCallID
+	c.stopInviteTimerLocked()
+	c.callState = CallStateEnded
+	prevSender := c.endCallLocked()
+	c.mu.Unlock()
+	if prevSender != nil {
+		if err := c.pc.RemoveTrack(prevSender); err != nil {
+			log.Println("remove send track on hangup error:", err)
+		}
+	}
+
+	if err := c.sendHangup(callID, event.CallHangupReason(reason)); err != nil {
+		return err
+	}
+	if c.listener != nil {
+		c.listener.OnCallEnded(callID, reason)
+	}
+	return nil
+}
+
+// Negotiate triggers an on-the-fly renegotiation of the current call, e.g.
+// to add a video track or restart ICE.
+func (c *Client) Negotiate() error {
+	c.mu.Lock()
+	if c.callState != CallStateConnected {
+		c.mu.Unlock()
+		return fmt.Errorf("no connected call to renegotiate")
+	}
+	callID := c.currentCallID
+	c.mu.Unlock()
+
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("CreateOffer (negotiate) error: %w", err)
+	}
+	if err := c.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("SetLocalDescription (negotiate) error: %w", err)
+	}
+
+	payload := map[string]interface{}{
+		"call_id":     callID,
+		"party_id":    c.myPartyID,
+		"version":     "1",
+		"lifetime":    defaultCallLifetime,
+		"description": map[string]interface{}{"type": "offer", "sdp": offer.SDP},
+	}
+	return c.sendCallEvent(context.Background(), event.CallNegotiate, payload)
+}
+
+func (c *Client) sendReject(callID string) error {
+	payload := map[string]interface{}{"call_id": callID, "party_id": c.myPartyID, "version": "1"}
+	return c.sendCallEvent(context.Background(), event.CallReject, payload)
+}
+
+func (c *Client) sendHangup(callID string, reason event.CallHangupReason) error {
+	payload := map[string]interface{}{
+		"call_id":  callID,
+		"party_id": c.myPartyID,
+		"version":  "1",
+		"reason":   reason,
+	}
+	return c.sendCallEvent(context.Background(), event.CallHangup, payload)
+}
+
+// startInviteTimerLocked arms the MSC2746 invite lifetime timeout. Callers
+// must hold c.mu.
+func (c *Client) startInviteTimerLocked(lifetimeMS int) {
+	if lifetimeMS <= 0 {
+		lifetimeMS = defaultCallLifetime
+	}
+	callID := c.currentCallID
+	c.inviteTimer = time.AfterFunc(time.Duration(lifetimeMS)*time.Millisecond, func() {
+		c.mu.Lock()
+		timedOut := c.currentCallID == callID && c.callState != CallStateConnected && c.callState != CallStateEnded
+		if timedOut {
+			c.callState = CallStateEnded
+		}
+		c.mu.Unlock()
+		if !timedOut {
+			return
+		}
+		if err := c.sendHangup(callID, event.CallHangupInviteTimeout); err != nil {
+			log.Println("send invite timeout hangup error:", err)
+		}
+		if c.listener != nil {
+			c.listener.OnCallEnded(callID, string(event.CallHangupInviteTimeout))
+		}
+	})
+}
+
+// stopInviteTimerLocked disarms the invite lifetime timeout, if any.
+// Callers must hold c.mu.
+func (c *Client) stopInviteTimerLocked() {
+	if c.inviteTimer != nil {
+		c.inviteTimer.Stop()
+		c.inviteTimer = nil
+	}
+}
+
+func (c *Client) handleCallInvite(ctx context.Context, evt *event.Event) {
+	if evt.Sender == c.myUserID {
+		return
+	}
+	content := evt.Content.AsCallInvite()
+
+	c.mu.Lock()
+	switch c.callState {
+	case CallStateInviteSent:
+		// Glare: both sides invited each other in the same room at once.
+		// The call with the lexicographically smaller call_id wins.
+		if content.CallID < c.currentCallID {
+			c.stopInviteTimerLocked()
+			c.callState = CallStateIdle
+			c.currentCallID = ""
+		} else {
+			c.mu.Unlock()
+			return
+		}
+	case CallStateIdle, CallStateEnded:
+		// proceed below
+	default:
+		// Already busy with another call; decline the new one.
+		c.mu.Unlock()
+		go c.sendReject(content.CallID)
+		return
+	}
+
+	c.currentCallID = content.CallID
+	c.remotePartyID = content.PartyID
+	c.callState = CallStateRinging
+	c.startInviteTimerLocked(content.Lifetime)
+	c.mu.Unlock()
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: content.Offer.SDP}
+	if err := c.pc.SetRemoteDescription(offer); err != nil {
+		log.Println("SetRemoteDescription (invite) error:", err)
+		return
+	}
+	if c.listener != nil {
+		c.listener.OnIncomingCall(content.CallID)
+	}
+}
+
+func (c *Client) handleCallAnswer(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsCallAnswer()
+
+	c.mu.Lock()
+	if c.callState != CallStateInviteSent || content.CallID != c.currentCallID {
+		c.mu.Unlock()
+		return
+	}
+	c.stopInviteTimerLocked()
+	c.remotePartyID = content.PartyID
+	c.callState = CallStateConnecting
+	c.mu.Unlock()
+
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: content.Answer.SDP}
+	if err := c.pc.SetRemoteDescription(answer); err != nil {
+		log.Println("SetRemoteDescription (answer) error:", err)
+		return
+	}
+
+	if mimeType, _, chans, err := negotiatedAudioCodec(answer); err != nil {
+		log.Println("negotiatedAudioCodec error:", err)
+	} else {
+		c.mu.Lock()
+		codec, err := NewCodec(mimeType, chans, c.opusConfig)
+		if err == nil {
+			c.sendCodec = codec
+		}
+		c.mu.Unlock()
+		if err != nil {
+			log.Println("negotiated codec unsupported, keeping previous:", err)
+		}
+	}
+
+	payload := map[string]interface{}{
+		"call_id":           content.CallID,
+		"party_id":          c.myPartyID,
+		"version":           "1",
+		"selected_party_id": content.PartyID,
+	}
+	if err := c.sendCallEvent(ctx, event.CallSelectAnswer, payload); err != nil {
+		log.Println("send select_answer error:", err)
+		return
+	}
+
+	c.mu.Lock()
+	if c.currentCallID == content.CallID {
+		c.callState = CallStateConnected
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) handleCallSelectAnswer(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsCallSelectAnswer()
+
+	c.mu.Lock()
+	if content.CallID != c.currentCallID || c.callState != CallStateConnecting {
+		c.mu.Unlock()
+		return
+	}
+	replaced := content.SelectedPartyID != c.myPartyID
+	if replaced {
+		c.callState = CallStateEnded
+	} else {
+		c.callState = CallStateConnected
+	}
+	c.mu.Unlock()
+
+	if replaced && c.listener != nil {
+		c.listener.OnCallEnded(content.CallID, "replaced_by_other_device")
+	}
+}
+
+func (c *Client) handleCallNegotiate(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsCallNegotiate()
+
+	c.mu.Lock()
+	active := content.CallID == c.currentCallID && c.callState == CallStateConnected
+	c.mu.Unlock()
+	if !active {
+		return
+	}
+
+	if content.Description.Type == event.CallDataTypeAnswer {
+		answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: content.Description.SDP}
+		if err := c.pc.SetRemoteDescription(answer); err != nil {
+			log.Println("SetRemoteDescription (negotiate answer) error:", err)
+		}
+		return
+	}
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: content.Description.SDP}
+	if err := c.pc.SetRemoteDescription(offer); err != nil {
+		log.Println("SetRemoteDescription (negotiate offer) error:", err)
+		return
+	}
+	ans, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		log.Println("CreateAnswer (negotiate) error:", err)
+		return
+	}
+	if err := c.pc.SetLocalDescription(ans); err != nil {
+		log.Println("SetLocalDescription (negotiate) error:", err)
+		return
+	}
+
+	payload := map[string]interface{}{
+		"call_id":     content.CallID,
+		"party_id":    c.myPartyID,
+		"version":     "1",
+		"lifetime":    defaultCallLifetime,
+		"description": map[string]interface{}{"type": "answer", "sdp": ans.SDP},
+	}
+	if err := c.sendCallEvent(ctx, event.CallNegotiate, payload); err != nil {
+		log.Println("send negotiate answer error:", err)
+	}
+}
+
+func (c *Client) handleCallHangup(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsCallHangup()
+
+	c.mu.Lock()
+	if content.CallID != c.currentCallID || c.callState == CallStateIdle || c.callState == CallStateEnded {
+		c.mu.Unlock()
+		return
+	}
+	c.stopInviteTimerLocked()
+	c.callState = CallStateEnded
+	c.mu.Unlock()
+
+	if c.listener != nil {
+		c.listener.OnRemoteHangup(content.CallID, string(content.Reason))
+		c.listener.OnCallEnded(content.CallID, string(content.Reason))
+	}
+}
+
+func (c *Client) handleCallReject(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsCallReject()
+
+	c.mu.Lock()
+	if content.CallID != c.currentCallID || c.callState != CallStateInviteSent {
+		c.mu.Unlock()
+		return
+	}
+	c.stopInviteTimerLocked()
+	c.callState = CallStateEnded
+	c.mu.Unlock()
+
+	if c.listener != nil {
+		c.listener.OnCallEnded(content.CallID, "rejected")
+	}
+}
+
+// handleCallCandidates consumes trickled remote ICE candidates and feeds
+// them into the PeerConnection as they arrive. An empty candidate string
+// marks the remote's end-of-candidates per MSC2746 and is ignored.
+func (c *Client) handleCallCandidates(ctx context.Context, evt *event.Event) {
+	if evt.Sender == c.myUserID {
+		return
+	}
+	content := evt.Content.AsCallCandidates()
+
+	c.mu.Lock()
+	active := content.CallID == c.currentCallID
+	c.mu.Unlock()
+	if !active {
+		return
+	}
+
+	for _, cand := range content.Candidates {
+		if cand.Candidate == "" {
+			continue
+		}
+		sdpMid := cand.SDPMID
+		sdpMLineIndex := uint16(cand.SDPMLineIndex)
+		init := webrtc.ICECandidateInit{
+			Candidate:     cand.Candidate,
+			SDPMid:        &sdpMid,
+			SDPMLineIndex: &sdpMLineIndex,
+		}
+		if err := c.pc.AddICECandidate(init); err != nil {
+			log.Println("AddICECandidate error:", err)
+		}
+	}
+}
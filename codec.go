@@ -0,0 +1,169 @@
+package matrixdll
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// Codec encodes and decodes the audio payload carried by one RTP media
+// format, so the send/receive pipeline isn't hard-wired to Opus.
+// Implementations must be safe to use from a single encode goroutine and a
+// single decode goroutine concurrently, but not from multiple of either.
+type Codec interface {
+	Encode(pcm []int16) ([]byte, error)
+	Decode(payload []byte) ([]int16, error)
+	MimeType() string
+	// ClockRate is the RTP/SDP clock rate, e.g. the "8000" in "PCMU/8000".
+	ClockRate() uint32
+	// SampleRate is the actual PCM sample rate the codec operates at. For
+	// every codec here this matches ClockRate.
+	SampleRate() uint32
+	Channels() uint16
+	PTime() time.Duration
+}
+
+// NewCodec builds a Codec for the given negotiated MimeType. opusCfg is
+// used when mimeType is Opus; it's ignored otherwise.
+func NewCodec(mimeType string, channels uint16, opusCfg OpusConfig) (Codec, error) {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		cfg := opusCfg
+		cfg.Stereo = channels == 2
+		return NewOpusCodec(cfg)
+	case strings.ToLower(webrtc.MimeTypePCMU):
+		return NewPCMUCodec(), nil
+	case strings.ToLower(webrtc.MimeTypePCMA):
+		return NewPCMACodec(), nil
+	default:
+		return nil, fmt.Errorf("unsupported codec mime type: %s", mimeType)
+	}
+}
+
+// depacketizerFor returns the rtp.Depacketizer samplebuilder needs to turn
+// RTP packets for mimeType back into codec payloads.
+func depacketizerFor(mimeType string) rtp.Depacketizer {
+	if strings.EqualFold(mimeType, webrtc.MimeTypeOpus) {
+		return &codecs.OpusPacket{}
+	}
+	// PCMU and PCMA carry raw samples directly in the RTP payload.
+	return &rawPayloadDepacketizer{}
+}
+
+// rawPayloadDepacketizer is the identity depacketizer for codecs (G.711)
+// whose RTP payload is the bare encoded audio with no extra framing.
+type rawPayloadDepacketizer struct{}
+
+func (rawPayloadDepacketizer) Unmarshal(packet []byte) ([]byte, error) { return packet, nil }
+func (rawPayloadDepacketizer) IsPartitionHead([]byte) bool             { return true }
+func (rawPayloadDepacketizer) IsPartitionTail(bool, []byte) bool       { return true }
+
+// startTrackReader decodes RTP from track into PCM and pushes it to out,
+// resampling to whatever rate appRate() currently reports. It picks the
+// Codec matching track's negotiated codec rather than assuming Opus, and
+// returns (without starting anything) if that codec isn't supported. It
+// blocks until the track ends, so callers run it in its own goroutine; it's
+// shared by Client's single remote track and each GroupCall peer's track.
+// decrypt, when non-nil, is applied to each depacketized payload before the
+// codec decodes it; Client passes its sframeCipher's Decrypt in EncryptedCall
+// mode, GroupCall always passes nil.
+func startTrackReader(track *webrtc.TrackRemote, opusCfg OpusConfig, appRate func() uint32, out chan<- []int16, decrypt func([]byte) ([]byte, error)) {
+	remoteCodec := track.Codec()
+	codec, err := NewCodec(remoteCodec.MimeType, remoteCodec.Channels, opusCfg)
+	if err != nil {
+		log.Println("unsupported remote codec:", err)
+		return
+	}
+	sb := samplebuilder.New(10, depacketizerFor(remoteCodec.MimeType), remoteCodec.ClockRate)
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		sb.Push(pkt)
+		for s := sb.Pop(); s != nil; s = sb.Pop() {
+			payload := s.Data
+			if decrypt != nil {
+				var decErr error
+				payload, decErr = decrypt(payload)
+				if decErr != nil {
+					log.Println("sframe decrypt error:", decErr)
+					continue
+				}
+			}
+			pcm, err := codec.Decode(payload)
+			if err != nil {
+				log.Println("Decode error:", err)
+				break
+			}
+			if len(pcm) == 0 {
+				continue // DTX: remote sent silence
+			}
+			rate := appRate()
+			if rate != codec.SampleRate() {
+				pcm = resamplePCM(pcm, codec.SampleRate(), rate, codec.Channels())
+			}
+			select {
+			case out <- pcm:
+			default:
+			}
+		}
+	}
+}
+
+// negotiatedAudioCodec inspects an SDP answer and returns the mime type,
+// clock rate and channel count of the first (i.e. preferred) audio codec it
+// offers, so the media pipeline can pick a matching Codec instead of
+// assuming Opus.
+func negotiatedAudioCodec(desc webrtc.SessionDescription) (mimeType string, clockRate uint32, channels uint16, err error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("unmarshal SDP: %w", err)
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if media.MediaName.Media != "audio" || len(media.MediaName.Formats) == 0 {
+			continue
+		}
+		pt := media.MediaName.Formats[0]
+		for _, attr := range media.Attributes {
+			if attr.Key != "rtpmap" || !strings.HasPrefix(attr.Value, pt+" ") {
+				continue
+			}
+			return parseRTPMap(attr.Value)
+		}
+	}
+	return "", 0, 0, fmt.Errorf("no negotiated audio codec found in SDP")
+}
+
+// parseRTPMap parses an "a=rtpmap" value such as "0 PCMU/8000" or
+// "111 opus/48000/2" into its mime type, clock rate and channel count.
+func parseRTPMap(value string) (mimeType string, clockRate uint32, channels uint16, err error) {
+	fields := strings.SplitN(value, " ", 2)
+	if len(fields) != 2 {
+		return "", 0, 0, fmt.Errorf("malformed rtpmap %q", value)
+	}
+	parts := strings.Split(fields[1], "/")
+	if len(parts) < 2 {
+		return "", 0, 0, fmt.Errorf("malformed rtpmap encoding %q", fields[1])
+	}
+	rate, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("parse clock rate %q: %w", parts[1], err)
+	}
+	channels = 1
+	if len(parts) == 3 {
+		ch, err := strconv.ParseUint(parts[2], 10, 16)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("parse channel count %q: %w", parts[2], err)
+		}
+		channels = uint16(ch)
+	}
+	return "audio/" + parts[0], uint32(rate), channels, nil
+}
@@ -0,0 +1,158 @@
+package matrixdll
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// g711ClockRate and g711PTime apply to both PCMU and PCMA: 8 kHz mono,
+// 20ms frames, one byte per sample.
+const g711ClockRate = 8000
+
+// PCMUCodec implements Codec for G.711 mu-law, used by most SIP bridges.
+type PCMUCodec struct{}
+
+func NewPCMUCodec() *PCMUCodec { return &PCMUCodec{} }
+
+func (PCMUCodec) Encode(pcm []int16) ([]byte, error) {
+	out := make([]byte, len(pcm))
+	for i, s := range pcm {
+		out[i] = linearToMuLaw(s)
+	}
+	return out, nil
+}
+
+func (PCMUCodec) Decode(payload []byte) ([]int16, error) {
+	out := make([]int16, len(payload))
+	for i, b := range payload {
+		out[i] = muLawToLinear(b)
+	}
+	return out, nil
+}
+
+func (PCMUCodec) MimeType() string     { return webrtc.MimeTypePCMU }
+func (PCMUCodec) ClockRate() uint32    { return g711ClockRate }
+func (PCMUCodec) SampleRate() uint32   { return g711ClockRate }
+func (PCMUCodec) Channels() uint16     { return 1 }
+func (PCMUCodec) PTime() time.Duration { return 20 * time.Millisecond }
+
+// PCMACodec implements Codec for G.711 A-law.
+type PCMACodec struct{}
+
+func NewPCMACodec() *PCMACodec { return &PCMACodec{} }
+
+func (PCMACodec) Encode(pcm []int16) ([]byte, error) {
+	out := make([]byte, len(pcm))
+	for i, s := range pcm {
+		out[i] = linearToALaw(s)
+	}
+	return out, nil
+}
+
+func (PCMACodec) Decode(payload []byte) ([]int16, error) {
+	out := make([]int16, len(payload))
+	for i, b := range payload {
+		out[i] = aLawToLinear(b)
+	}
+	return out, nil
+}
+
+func (PCMACodec) MimeType() string     { return webrtc.MimeTypePCMA }
+func (PCMACodec) ClockRate() uint32    { return g711ClockRate }
+func (PCMACodec) SampleRate() uint32   { return g711ClockRate }
+func (PCMACodec) Channels() uint16     { return 1 }
+func (PCMACodec) PTime() time.Duration { return 20 * time.Millisecond }
+
+// The mu-law/A-law conversions below follow the standard ITU-T G.711
+// reference algorithm (as found in most open source telephony stacks).
+
+const (
+	muLawBias = 0x84
+	muLawClip = 32635
+)
+
+func linearToMuLaw(sample int16) byte {
+	s := int(sample)
+	sign := 0
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > muLawClip {
+		s = muLawClip
+	}
+	s += muLawBias
+
+	exponent := 7
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (s >> (exponent + 3)) & 0x0F
+	return ^byte(sign | (exponent << 4) | mantissa)
+}
+
+func muLawToLinear(ulaw byte) int16 {
+	ulaw = ^ulaw
+	sign := ulaw & 0x80
+	exponent := int((ulaw >> 4) & 0x07)
+	mantissa := int(ulaw & 0x0F)
+
+	sample := (mantissa << 3) + muLawBias
+	sample <<= exponent
+	sample -= muLawBias
+	if sign != 0 {
+		sample = -sample
+	}
+	return int16(sample)
+}
+
+var aLawSegmentEnd = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+
+func linearToALaw(sample int16) byte {
+	s := int(sample) >> 3
+	mask := 0xD5
+	if s < 0 {
+		mask = 0x55
+		s = -s - 1
+	}
+
+	seg := len(aLawSegmentEnd)
+	for i, end := range aLawSegmentEnd {
+		if s <= end {
+			seg = i
+			break
+		}
+	}
+	if seg >= len(aLawSegmentEnd) {
+		return byte(0x7F ^ mask)
+	}
+
+	aval := byte(seg << 4)
+	if seg < 2 {
+		aval |= byte(s>>1) & 0x0F
+	} else {
+		aval |= byte(s>>uint(seg)) & 0x0F
+	}
+	return aval ^ byte(mask)
+}
+
+func aLawToLinear(aval byte) int16 {
+	aval ^= 0x55
+	seg := int(aval&0x70) >> 4
+	t := int(aval&0x0F) << 4
+
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= uint(seg - 1)
+	}
+	if aval&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
@@ -0,0 +1,781 @@
+package matrixdll
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// CallMemberEventType is the MSC3401 state event a member publishes to list
+// their devices' active calls and media feeds. It isn't registered in
+// maunium.net/go/mautrix's event package, so GroupCall marshals/unmarshals
+// its content directly via event.Content.Raw/VeryRaw instead of an AsXxx
+// helper.
+var CallMemberEventType = event.Type{Type: "m.call.member", Class: event.StateEventType}
+
+// GroupCallMemberFeed describes one media feed (e.g. audio) a device is
+// offering into the call.
+type GroupCallMemberFeed struct {
+	Purpose string `json:"purpose"`
+}
+
+// GroupCallMemberDevice is one of a member's devices participating in a
+// group call.
+type GroupCallMemberDevice struct {
+	DeviceID  string                `json:"device_id"`
+	SessionID string                `json:"session_id"`
+	Feeds     []GroupCallMemberFeed `json:"feeds"`
+	Foci      []GroupCallFocus      `json:"foci_active,omitempty"`
+}
+
+// GroupCallFocus describes an SFU a homeserver or member advertises for a
+// group call via foci_active. GroupCall parses it but always meshes
+// directly with every other participant; routing media through a focus
+// instead isn't implemented yet.
+type GroupCallFocus struct {
+	Type       string `json:"type"`
+	ServiceURL string `json:"livekit_service_url,omitempty"`
+}
+
+// GroupCallMemberCall is one active call a member's devices are part of.
+type GroupCallMemberCall struct {
+	CallID  string                  `json:"call_id"`
+	Devices []GroupCallMemberDevice `json:"devices"`
+}
+
+// GroupCallMemberEventContent is the content of an m.call.member state
+// event, keyed by state_key == the member's user ID.
+type GroupCallMemberEventContent struct {
+	Calls []GroupCallMemberCall `json:"m.calls"`
+}
+
+// GroupCallListener receives group call membership events. Implementations
+// are driven from the mautrix sync loop, so methods must not block. Kept to
+// primitive types so it can be bound via golang.org/x/mobile/bind.
+type GroupCallListener interface {
+	OnParticipantJoined(userID string)
+	OnParticipantLeft(userID string)
+	OnGroupCallEnded(reason string)
+}
+
+// participantKey identifies one remote device's peer connection within a
+// GroupCall.
+type participantKey struct {
+	userID   id.UserID
+	deviceID string
+}
+
+// groupCallPeer is the mesh connection to a single remote device.
+type groupCallPeer struct {
+	pc        *webrtc.PeerConnection
+	sendTrack *webrtc.TrackLocalStaticSample
+	partyID   string
+}
+
+// GroupCall implements MSC3401 group calling: it publishes an m.call.member
+// state event advertising this device, discovers other members the same
+// way, and meshes a PeerConnection per remote device. A member's m.call.member
+// state may advertise a foci_active SFU (see GroupCallFocus), but routing
+// through one instead of meshing isn't implemented yet; every participant is
+// meshed directly regardless of what's advertised. It's the group-call
+// counterpart to Client, which only handles 1:1 calls.
+type GroupCall struct {
+	homeserver string
+	username   string
+	password   string
+	roomID     string
+
+	mautrixClient *mautrix.Client
+	api           *webrtc.API
+
+	myUserID   id.UserID
+	myDeviceID string
+	myPartyID  string
+
+	opusConfig OpusConfig
+
+	mu             sync.Mutex
+	groupCallID    string
+	active         bool
+	peers          map[participantKey]*groupCallPeer
+	peerSessionIDs map[participantKey]string
+	audioChans     map[id.UserID]chan []int16
+	dataCh         chan []int16
+	listener       GroupCallListener
+}
+
+// NewGroupCall logs in and prepares a GroupCall for roomID. deviceID
+// identifies this device in the m.call.member state it publishes; it
+// should be stable across restarts (e.g. the mautrix device ID).
+func NewGroupCall(homeserver, username, password, roomID, deviceID string) (*GroupCall, error) {
+	gc := &GroupCall{
+		homeserver:     homeserver,
+		username:       username,
+		password:       password,
+		roomID:         roomID,
+		myDeviceID:     deviceID,
+		myPartyID:      uuid.NewString(),
+		peers:          make(map[participantKey]*groupCallPeer),
+		peerSessionIDs: make(map[participantKey]string),
+		audioChans:     make(map[id.UserID]chan []int16),
+		dataCh:         make(chan []int16, 50),
+	}
+
+	mcl, err := mautrix.NewClient(gc.homeserver, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("mautrix NewClient: %w", err)
+	}
+	resp, err := mcl.Login(context.Background(), &mautrix.ReqLogin{
+		Type:       "m.login.password",
+		Identifier: mautrix.UserIdentifier{Type: "m.id.user", User: gc.username},
+		Password:   gc.password,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("login error: %w", err)
+	}
+	mcl.SetCredentials(resp.UserID, resp.AccessToken)
+	gc.mautrixClient = mcl
+	gc.myUserID = resp.UserID
+
+	api, err := newWebRTCAPI(nil)
+	if err != nil {
+		return nil, err
+	}
+	gc.api = api
+
+	if syncer, ok := gc.mautrixClient.Syncer.(*mautrix.DefaultSyncer); ok {
+		syncer.OnEventType(CallMemberEventType, gc.handleMemberState)
+		syncer.OnEventType(event.CallInvite, gc.handleGroupInvite)
+		syncer.OnEventType(event.CallAnswer, gc.handleGroupAnswer)
+		syncer.OnEventType(event.CallHangup, gc.handleGroupHangup)
+		syncer.OnEventType(event.CallCandidates, gc.handleGroupCandidates)
+	}
+
+	return gc, nil
+}
+
+// SetOpusConfig configures Opus encode/decode parameters for every peer
+// this GroupCall creates from here on. Call it before StartGroupCall.
+func (gc *GroupCall) SetOpusConfig(cfg OpusConfig) {
+	gc.mu.Lock()
+	gc.opusConfig = cfg
+	gc.mu.Unlock()
+}
+
+// SetGroupCallListener registers the callback interface used to drive a
+// mobile binding's UI from membership events.
+func (gc *GroupCall) SetGroupCallListener(l GroupCallListener) {
+	gc.mu.Lock()
+	gc.listener = l
+	gc.mu.Unlock()
+}
+
+// StartGroupCall publishes our m.call.member state, invites every other
+// member already present in the room, and starts the sync loop that
+// discovers members joining later.
+func (gc *GroupCall) StartGroupCall() error {
+	gc.mu.Lock()
+	if gc.active {
+		gc.mu.Unlock()
+		return fmt.Errorf("group call already active")
+	}
+	gc.groupCallID = fmt.Sprintf("group-call-%d", time.Now().Unix())
+	gc.active = true
+	gc.mu.Unlock()
+
+	if err := gc.publishMemberState(); err != nil {
+		return fmt.Errorf("publish m.call.member: %w", err)
+	}
+
+	state, err := gc.mautrixClient.State(context.Background(), id.RoomID(gc.roomID))
+	if err != nil {
+		return fmt.Errorf("fetch room state: %w", err)
+	}
+	for stateKey, evt := range state[CallMemberEventType] {
+		userID := id.UserID(stateKey)
+		if userID == gc.myUserID {
+			continue
+		}
+		var content GroupCallMemberEventContent
+		if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+			log.Println("parse m.call.member error:", err)
+			continue
+		}
+		for _, call := range content.Calls {
+			for _, dev := range call.Devices {
+				gc.rememberSessionID(userID, dev.DeviceID, dev.SessionID)
+				if err := gc.invitePeer(userID, dev.DeviceID); err != nil {
+					log.Println("invite peer error:", err)
+				}
+			}
+		}
+	}
+
+	if err := gc.startSendLoop(); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			if err := gc.mautrixClient.Sync(); err != nil {
+				log.Println("Sync error:", err)
+				time.Sleep(syncRetryGap)
+			}
+		}
+	}()
+	return nil
+}
+
+// publishMemberState sends the m.call.member state event advertising this
+// device's audio feed in the current group call.
+func (gc *GroupCall) publishMemberState() error {
+	gc.mu.Lock()
+	content := GroupCallMemberEventContent{
+		Calls: []GroupCallMemberCall{{
+			CallID: gc.groupCallID,
+			Devices: []GroupCallMemberDevice{{
+				DeviceID:  gc.myDeviceID,
+				SessionID: gc.myPartyID,
+				Feeds:     []GroupCallMemberFeed{{Purpose: "m.usermedia"}},
+			}},
+		}},
+	}
+	gc.mu.Unlock()
+
+	_, err := gc.mautrixClient.SendStateEvent(
+		context.Background(),
+		id.RoomID(gc.roomID),
+		CallMemberEventType,
+		string(gc.myUserID),
+		content,
+	)
+	return err
+}
+
+// isRoomEncrypted reports whether roomID has an m.room.encryption state
+// event, in which case call signaling must go over to-device messages
+// rather than room events.
+func (gc *GroupCall) isRoomEncrypted() bool {
+	var content event.EncryptionEventContent
+	err := gc.mautrixClient.StateEvent(context.Background(), id.RoomID(gc.roomID), event.StateEncryption, "", &content)
+	return err == nil && content.Algorithm != ""
+}
+
+// addPeerLocked creates the PeerConnection, send track and ICE wiring for
+// one remote device. Callers must hold gc.mu and must not already have an
+// entry for key.
+func (gc *GroupCall) addPeerLocked(key participantKey) (*groupCallPeer, error) {
+	pc, err := gc.api.NewPeerConnection(webrtc.Configuration{
+		ICETransportPolicy: webrtc.ICETransportPolicyAll,
+		ICEServers:         iceServers(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("NewPeerConnection: %w", err)
+	}
+
+	initialCodec, err := NewOpusCodec(gc.opusConfig)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("build initial codec: %w", err)
+	}
+	sendTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: initialCodec.MimeType(), ClockRate: initialCodec.ClockRate(), Channels: initialCodec.Channels()},
+		"matrix-group-send", "audio-"+key.deviceID,
+	)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("create send track: %w", err)
+	}
+	sender, err := pc.AddTrack(sendTrack)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("add send track: %w", err)
+	}
+	go drainSenderRTCP(sender)
+
+	pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
+		gc.sendCandidate(key, cand)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Println("group call peer", key.userID, key.deviceID, "state:", state)
+	})
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeAudio {
+			return
+		}
+		go drainReceiverRTCP(receiver)
+		out := gc.audioChanFor(key.userID)
+		gc.mu.Lock()
+		opusCfg := gc.opusConfig
+		gc.mu.Unlock()
+		go startTrackReader(track, opusCfg, func() uint32 { return sampleRate }, out, nil)
+	})
+
+	peer := &groupCallPeer{pc: pc, sendTrack: sendTrack, partyID: gc.myPartyID}
+	gc.peers[key] = peer
+	return peer, nil
+}
+
+// rememberSessionID records the session ID a device advertises in its
+// m.call.member entry, so sendCandidate can address candidates to it by
+// session as MSC3401 expects instead of guessing. A blank sessionID is
+// ignored rather than overwriting one we already know.
+func (gc *GroupCall) rememberSessionID(userID id.UserID, deviceID, sessionID string) {
+	if sessionID == "" {
+		return
+	}
+	gc.mu.Lock()
+	gc.peerSessionIDs[participantKey{userID: userID, deviceID: deviceID}] = sessionID
+	gc.mu.Unlock()
+}
+
+// audioChanFor returns the per-participant PCM channel for userID, creating
+// it if this is the first device we've seen for them.
+func (gc *GroupCall) audioChanFor(userID id.UserID) chan []int16 {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	ch, ok := gc.audioChans[userID]
+	if !ok {
+		ch = make(chan []int16, 50)
+		gc.audioChans[userID] = ch
+	}
+	return ch
+}
+
+// sendCandidate trickles a local ICE candidate for the peer identified by
+// key, the same way Client does for its single PeerConnection.
+func (gc *GroupCall) sendCandidate(key participantKey, cand *webrtc.ICECandidate) {
+	var candJSON map[string]interface{}
+	if cand == nil {
+		candJSON = map[string]interface{}{"candidate": "", "sdpMid": "", "sdpMLineIndex": 0}
+	} else {
+		ice := cand.ToJSON()
+		candJSON = map[string]interface{}{
+			"candidate":     ice.Candidate,
+			"sdpMid":        ice.SDPMid,
+			"sdpMLineIndex": ice.SDPMLineIndex,
+		}
+	}
+	gc.mu.Lock()
+	callID := gc.groupCallID
+	destSessionID := gc.peerSessionIDs[key]
+	gc.mu.Unlock()
+	payload := map[string]interface{}{
+		"call_id":         callID,
+		"party_id":        gc.myPartyID,
+		"version":         "1",
+		"device_id":       gc.myDeviceID,
+		"dest_device_id":  key.deviceID,
+		"dest_session_id": destSessionID,
+		"candidates":      []interface{}{candJSON},
+	}
+	if err := gc.sendOrToDevice(key.userID, key.deviceID, event.CallCandidates, payload); err != nil {
+		log.Println("send group ICE candidate error:", err)
+	}
+}
+
+// inviteWins reports whether we should be the one to send (userID, deviceID)
+// an m.call.invite, rather than waiting for them to invite us. It compares
+// (user ID, device ID) pairs lexicographically so that exactly one side of
+// any pair invites; it's the mesh counterpart of the lexicographic call_id
+// comparison handleCallInvite uses to resolve 1:1 glare. Without it, two
+// members calling StartGroupCall around the same time both invite each
+// other, and the second SetRemoteDescription(offer) to arrive fails because
+// the receiving peer connection is already in have-local-offer state from
+// its own outbound invite.
+func (gc *GroupCall) inviteWins(userID id.UserID, deviceID string) bool {
+	local := string(gc.myUserID) + "|" + gc.myDeviceID
+	remote := string(userID) + "|" + deviceID
+	return local < remote
+}
+
+// invitePeer creates the peer connection for (userID, deviceID) and sends
+// it an m.call.invite. Skips devices that already have a peer (e.g. a
+// duplicate membership update), and skips inviting at all when inviteWins
+// says the other side should invite us instead; handleGroupInvite creates
+// the peer and answers when that invite arrives.
+func (gc *GroupCall) invitePeer(userID id.UserID, deviceID string) error {
+	key := participantKey{userID: userID, deviceID: deviceID}
+
+	gc.mu.Lock()
+	if _, exists := gc.peers[key]; exists {
+		gc.mu.Unlock()
+		return nil
+	}
+	if !gc.inviteWins(userID, deviceID) {
+		gc.mu.Unlock()
+		return nil
+	}
+	peer, err := gc.addPeerLocked(key)
+	if err != nil {
+		gc.mu.Unlock()
+		return err
+	}
+	callID := gc.groupCallID
+	gc.mu.Unlock()
+
+	offer, err := peer.pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("CreateOffer error: %w", err)
+	}
+	if err := peer.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("SetLocalDescription error: %w", err)
+	}
+
+	payload := map[string]interface{}{
+		"call_id":        callID,
+		"party_id":       gc.myPartyID,
+		"version":        "1",
+		"lifetime":       defaultCallLifetime,
+		"device_id":      gc.myDeviceID,
+		"dest_device_id": deviceID,
+		"offer":          map[string]interface{}{"type": "offer", "sdp": offer.SDP},
+	}
+	if err := gc.sendOrToDevice(userID, deviceID, event.CallInvite, payload); err != nil {
+		return fmt.Errorf("send group invite: %w", err)
+	}
+
+	if listener := gc.listenerOrNil(); listener != nil {
+		listener.OnParticipantJoined(string(userID))
+	}
+	return nil
+}
+
+// sendOrToDevice sends payload as a room event, or as a to-device message
+// addressed to (userID, deviceID) when the room is encrypted, per MSC3401's
+// to-device signalling fallback.
+func (gc *GroupCall) sendOrToDevice(userID id.UserID, deviceID string, eventType event.Type, payload map[string]interface{}) error {
+	if gc.isRoomEncrypted() {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("marshal to-device content: %w", err)
+		}
+		_, err = gc.mautrixClient.SendToDevice(context.Background(), eventType, &mautrix.ReqSendToDevice{
+			Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+				userID: {id.DeviceID(deviceID): {VeryRaw: raw, Raw: payload}},
+			},
+		})
+		return err
+	}
+	_, err := gc.mautrixClient.SendMessageEvent(context.Background(), id.RoomID(gc.roomID), eventType, payload)
+	return err
+}
+
+func (gc *GroupCall) listenerOrNil() GroupCallListener {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.listener
+}
+
+// handleMemberState reconciles our mesh against an updated m.call.member
+// state event: new devices get invited, devices that disappeared get their
+// peer torn down.
+func (gc *GroupCall) handleMemberState(ctx context.Context, evt *event.Event) {
+	if evt.StateKey == nil {
+		return
+	}
+	userID := id.UserID(*evt.StateKey)
+	if userID == gc.myUserID {
+		return
+	}
+
+	var content GroupCallMemberEventContent
+	if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+		log.Println("parse m.call.member error:", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, call := range content.Calls {
+		for _, dev := range call.Devices {
+			seen[dev.DeviceID] = true
+			gc.rememberSessionID(userID, dev.DeviceID, dev.SessionID)
+			if err := gc.invitePeer(userID, dev.DeviceID); err != nil {
+				log.Println("invite peer error:", err)
+			}
+		}
+	}
+
+	gc.mu.Lock()
+	var stale []participantKey
+	for key := range gc.peers {
+		if key.userID == userID && !seen[key.deviceID] {
+			stale = append(stale, key)
+		}
+	}
+	gc.mu.Unlock()
+
+	for _, key := range stale {
+		gc.removePeer(key, "left")
+	}
+}
+
+func (gc *GroupCall) handleGroupInvite(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsCallInvite()
+	deviceID, _ := evt.Content.Raw["device_id"].(string)
+	if deviceID == "" || content.Offer.SDP == "" {
+		return
+	}
+	key := participantKey{userID: evt.Sender, deviceID: deviceID}
+
+	gc.mu.Lock()
+	peer, exists := gc.peers[key]
+	var err error
+	if !exists {
+		peer, err = gc.addPeerLocked(key)
+	}
+	gc.mu.Unlock()
+	if err != nil {
+		log.Println("accept group invite error:", err)
+		return
+	}
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: content.Offer.SDP}
+	if err := peer.pc.SetRemoteDescription(offer); err != nil {
+		log.Println("SetRemoteDescription (group invite) error:", err)
+		return
+	}
+	ans, err := peer.pc.CreateAnswer(nil)
+	if err != nil {
+		log.Println("CreateAnswer (group invite) error:", err)
+		return
+	}
+	if err := peer.pc.SetLocalDescription(ans); err != nil {
+		log.Println("SetLocalDescription (group invite) error:", err)
+		return
+	}
+
+	payload := map[string]interface{}{
+		"call_id":        content.CallID,
+		"party_id":       gc.myPartyID,
+		"version":        "1",
+		"device_id":      gc.myDeviceID,
+		"dest_device_id": deviceID,
+		"answer":         map[string]interface{}{"type": "answer", "sdp": ans.SDP},
+	}
+	if err := gc.sendOrToDevice(evt.Sender, deviceID, event.CallAnswer, payload); err != nil {
+		log.Println("send group answer error:", err)
+	}
+}
+
+func (gc *GroupCall) handleGroupAnswer(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsCallAnswer()
+	deviceID, _ := evt.Content.Raw["device_id"].(string)
+	if deviceID == "" {
+		return
+	}
+	key := participantKey{userID: evt.Sender, deviceID: deviceID}
+
+	gc.mu.Lock()
+	peer, exists := gc.peers[key]
+	gc.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: content.Answer.SDP}
+	if err := peer.pc.SetRemoteDescription(answer); err != nil {
+		log.Println("SetRemoteDescription (group answer) error:", err)
+	}
+}
+
+func (gc *GroupCall) handleGroupHangup(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsCallHangup()
+	deviceID, _ := evt.Content.Raw["device_id"].(string)
+	if deviceID == "" {
+		return
+	}
+	gc.removePeer(participantKey{userID: evt.Sender, deviceID: deviceID}, string(content.Reason))
+}
+
+func (gc *GroupCall) handleGroupCandidates(ctx context.Context, evt *event.Event) {
+	content := evt.Content.AsCallCandidates()
+	deviceID, _ := evt.Content.Raw["device_id"].(string)
+	if deviceID == "" {
+		return
+	}
+	key := participantKey{userID: evt.Sender, deviceID: deviceID}
+
+	gc.mu.Lock()
+	peer, exists := gc.peers[key]
+	gc.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	for _, cand := range content.Candidates {
+		if cand.Candidate == "" {
+			continue
+		}
+		sdpMid := cand.SDPMID
+		sdpMLineIndex := uint16(cand.SDPMLineIndex)
+		init := webrtc.ICECandidateInit{
+			Candidate:     cand.Candidate,
+			SDPMid:        &sdpMid,
+			SDPMLineIndex: &sdpMLineIndex,
+		}
+		if err := peer.pc.AddICECandidate(init); err != nil {
+			log.Println("AddICECandidate (group) error:", err)
+		}
+	}
+}
+
+// removePeer closes and forgets the peer connection for key, notifying the
+// listener if this was the remote's last device in the call.
+func (gc *GroupCall) removePeer(key participantKey, reason string) {
+	gc.mu.Lock()
+	peer, exists := gc.peers[key]
+	if exists {
+		delete(gc.peers, key)
+	}
+	remaining := false
+	for k := range gc.peers {
+		if k.userID == key.userID {
+			remaining = true
+			break
+		}
+	}
+	listener := gc.listener
+	gc.mu.Unlock()
+
+	if !exists {
+		return
+	}
+	log.Println("group call peer", key.userID, key.deviceID, "removed:", reason)
+	peer.pc.Close()
+
+	if !remaining && listener != nil {
+		listener.OnParticipantLeft(string(key.userID))
+	}
+}
+
+// SendAudio encodes and fans data (raw 16-bit LE PCM at sampleRate) out to
+// every connected peer. Unlike Client.SendAudio, there's no per-call
+// resampling hook yet: callers must already provide sampleRate audio.
+func (gc *GroupCall) SendAudio(data []byte) error {
+	n := len(data) / 2
+	samples := make([]int16, n)
+	for i := 0; i < n; i++ {
+		samples[i] = int16(data[2*i]) | int16(data[2*i+1])<<8
+	}
+	select {
+	case gc.dataCh <- samples:
+	default:
+	}
+	return nil
+}
+
+// ReceiveAudioFrom returns the next decoded PCM frame (16-bit LE) received
+// from userID, blocking until one arrives. It returns an error if userID
+// isn't a participant we've ever received a track from.
+func (gc *GroupCall) ReceiveAudioFrom(userID string) ([]byte, error) {
+	gc.mu.Lock()
+	ch, ok := gc.audioChans[id.UserID(userID)]
+	gc.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no audio from participant %s", userID)
+	}
+	pcm := <-ch
+	out := make([]byte, len(pcm)*2)
+	for i, v := range pcm {
+		out[2*i] = byte(v)
+		out[2*i+1] = byte(v >> 8)
+	}
+	return out, nil
+}
+
+// startSendLoop begins encoding dataCh frames with a fresh Opus codec and
+// fanning them out to every currently connected peer's send track. Call it
+// once, after StartGroupCall.
+func (gc *GroupCall) startSendLoop() error {
+	gc.mu.Lock()
+	cfg := gc.opusConfig
+	gc.mu.Unlock()
+	codec, err := NewOpusCodec(cfg)
+	if err != nil {
+		return fmt.Errorf("build send codec: %w", err)
+	}
+
+	go func() {
+		for pcm := range gc.dataCh {
+			pkt, err := codec.Encode(pcm)
+			if err != nil {
+				log.Println("group encode error:", err)
+				continue
+			}
+			if len(pkt) == 0 {
+				continue // DTX: this frame was silence
+			}
+			sample := media.Sample{Data: pkt, Duration: codec.PTime()}
+
+			gc.mu.Lock()
+			tracks := make([]*webrtc.TrackLocalStaticSample, 0, len(gc.peers))
+			for _, peer := range gc.peers {
+				tracks = append(tracks, peer.sendTrack)
+			}
+			gc.mu.Unlock()
+
+			for _, track := range tracks {
+				if err := track.WriteSample(sample); err != nil {
+					log.Println("group WriteSample error:", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// EndGroupCall hangs up on every peer, clears our m.call.member state and
+// stops the call.
+func (gc *GroupCall) EndGroupCall(reason string) error {
+	gc.mu.Lock()
+	if !gc.active {
+		gc.mu.Unlock()
+		return fmt.Errorf("no active group call")
+	}
+	gc.active = false
+	callID := gc.groupCallID
+	keys := make([]participantKey, 0, len(gc.peers))
+	for key := range gc.peers {
+		keys = append(keys, key)
+	}
+	gc.mu.Unlock()
+
+	for _, key := range keys {
+		payload := map[string]interface{}{
+			"call_id":        callID,
+			"party_id":       gc.myPartyID,
+			"version":        "1",
+			"device_id":      gc.myDeviceID,
+			"dest_device_id": key.deviceID,
+			"reason":         event.CallHangupReason(reason),
+		}
+		if err := gc.sendOrToDevice(key.userID, key.deviceID, event.CallHangup, payload); err != nil {
+			log.Println("send group hangup error:", err)
+		}
+		gc.removePeer(key, reason)
+	}
+
+	_, err := gc.mautrixClient.SendStateEvent(
+		context.Background(),
+		id.RoomID(gc.roomID),
+		CallMemberEventType,
+		string(gc.myUserID),
+		GroupCallMemberEventContent{},
+	)
+
+	if listener := gc.listenerOrNil(); listener != nil {
+		listener.OnGroupCallEnded(reason)
+	}
+	return err
+}
@@ -1,259 +1,543 @@
-package matrixdll
-
-import (
-	"context"
-	"fmt"
-	"log"
-	"time"
-
-	 _ "golang.org/x/mobile/bind"
-	"github.com/google/uuid"
-	"github.com/pion/rtp/codecs"
-	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
-	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
-	"layeh.com/gopus"
-	"maunium.net/go/mautrix"
-	"maunium.net/go/mautrix/event"
-	"maunium.net/go/mautrix/id"
-)
-
-const (
-	sampleRate   = 48000
-	channels     = 1
-	frameSize    = 960
-	opusBufSize  = 4000
-	syncRetryGap = time.Second
-)
-
-type Client struct {
-	homeserver    string
-	username      string
-	password      string
-	roomID        string
-	mautrixClient *mautrix.Client
-	pc            *webrtc.PeerConnection
-
-	currentCallID string
-	myPartyID     string
-	myUserID      id.UserID
-
-	dataCh   chan []int16
-	decodeCh chan []int16
-}
-
-func NewClient(homeserver, username, password, roomID string) (*Client, error) {
-	c := &Client{
-		homeserver: homeserver,
-		username:   username,
-		password:   password,
-		roomID:     roomID,
-		dataCh:     make(chan []int16, 50),
-		decodeCh:   make(chan []int16, 50),
-	}
-
-	mcl, err := mautrix.NewClient(c.homeserver, "", "")
-	if err != nil {
-		return nil, fmt.Errorf("mautrix NewClient: %w", err)
-	}
-	resp, err := mcl.Login(context.Background(), &mautrix.ReqLogin{
-		Type:       "m.login.password",
-		Identifier: mautrix.UserIdentifier{Type: "m.id.user", User: c.username},
-		Password:   c.password,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("login error: %w", err)
-	}
-	mcl.SetCredentials(resp.UserID, resp.AccessToken)
-	c.mautrixClient = mcl
-	c.myUserID = resp.UserID
-	c.myPartyID = uuid.NewString()
-
-	conf := webrtc.Configuration{
-		ICETransportPolicy: webrtc.ICETransportPolicyAll,
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-			{URLs: []string{"turn:webqalqan.com:3478"}, Username: "turnuser", Credential: "turnpass"},
-		},
-	}
-	pc, err := webrtc.NewPeerConnection(conf)
-	if err != nil {
-		return nil, fmt.Errorf("NewPeerConnection: %w", err)
-	}
-
-	pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
-		if cand == nil {
-			return
-		}
-		ice := cand.ToJSON()
-		payload := map[string]interface{}{
-			"call_id":  c.currentCallID,
-			"party_id": c.myPartyID,
-			"version":  "1",
-			"candidates": []interface{}{
-				map[string]interface{}{
-					"candidate":     ice.Candidate,
-					"sdpMid":        ice.SDPMid,
-					"sdpMLineIndex": ice.SDPMLineIndex,
-				},
-			},
-		}
-		if _, err := c.mautrixClient.SendMessageEvent(
-			context.Background(),
-			id.RoomID(c.roomID),
-			event.CallCandidates,
-			payload,
-		); err != nil {
-			log.Println("Send ICE candidate error:", err)
-		}
-	})
-
-	// Log state changes
-	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		log.Println("PeerConnection state:", state)
-	})
-	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		log.Println("ICE connection state:", state)
-	})
-
-	// Incoming audio handler
-	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
-		if track.Kind() != webrtc.RTPCodecTypeAudio {
-			return
-		}
-		go func() {
-			sb := samplebuilder.New(10, &codecs.OpusPacket{}, track.Codec().ClockRate)
-			dec, err := gopus.NewDecoder(sampleRate, channels)
-			if err != nil {
-				log.Println("Decoder init error:", err)
-				return
-			}
-			for {
-				pkt, _, err := track.ReadRTP()
-				if err != nil {
-					return
-				}
-				sb.Push(pkt)
-				for s := sb.Pop(); s != nil; s = sb.Pop() {
-					pcm, err := dec.Decode(s.Data, frameSize, false)
-					if err != nil {
-						log.Println("Decode error:", err)
-						break
-					}
-					select {
-					case c.decodeCh <- pcm:
-					default:
-					}
-				}
-			}
-		}()
-	})
-
-	c.pc = pc
-	return c, nil
-}
-
-func (c *Client) StartCall() error {
-	enc, err := gopus.NewEncoder(sampleRate, channels, gopus.Voip)
-	if err != nil {
-		return fmt.Errorf("gopus encoder: %w", err)
-	}
-	sendTrack, err := webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: sampleRate, Channels: channels},
-		"matrix-send", "audio",
-	)
-	if err != nil {
-		return fmt.Errorf("create send track: %w", err)
-	}
-	if _, err := c.pc.AddTrack(sendTrack); err != nil {
-		return fmt.Errorf("add send track: %w", err)
-	}
-	c.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		if state == webrtc.PeerConnectionStateConnected {
-			go func() {
-				for pcm := range c.dataCh {
-					pkt, err := enc.Encode(pcm, frameSize, opusBufSize)
-					if err != nil {
-						log.Println("encode error:", err)
-						continue
-					}
-					if err := sendTrack.WriteSample(media.Sample{Data: pkt, Duration: 20 * time.Millisecond}); err != nil {
-						log.Println("WriteSample error:", err)
-					}
-				}
-			}()
-		}
-	})
-
-	go func() {
-		for {
-			if err := c.mautrixClient.Sync(); err != nil {
-				log.Println("Sync error:", err)
-				time.Sleep(syncRetryGap)
-			}
-		}
-	}()
-
-	c.currentCallID = fmt.Sprintf("call-%d", time.Now().Unix())
-	sdp, err := BuildOfferSDP(c.pc)
-	if err != nil {
-		return fmt.Errorf("BuildOfferSDP error: %w", err)
-	}
-	invite := map[string]interface{}{
-		"call_id":  c.currentCallID,
-		"lifetime": 60000,
-		"offer":    map[string]interface{}{"type": "offer", "sdp": sdp},
-		"version":  "1",
-		"party_id": c.myPartyID,
-	}
-	if _, err := c.mautrixClient.SendMessageEvent(
-		context.Background(),
-		id.RoomID(c.roomID),
-		event.CallInvite,
-		invite,
-	); err != nil {
-		return fmt.Errorf("send invite: %w", err)
-	}
-	return nil
-}
-
-func BuildOfferSDP(pc *webrtc.PeerConnection) (string, error) {
-	off, err := pc.CreateOffer(nil)
-	if err != nil {
-		return "", fmt.Errorf("CreateOffer error: %w", err)
-	}
-	if err := pc.SetLocalDescription(off); err != nil {
-		return "", fmt.Errorf("SetLocalDescription error: %w", err)
-	}
-	<-webrtc.GatheringCompletePromise(pc)
-	return off.SDP, nil
-}
-
-func (c *Client) SendAudio(data []byte) error {
-	if c.dataCh == nil {
-		return fmt.Errorf("client not initialized")
-	}
-	n := len(data) / 2
-	samples := make([]int16, n)
-	for i := 0; i < n; i++ {
-		samples[i] = int16(data[2*i]) | int16(data[2*i+1])<<8
-	}
-	select {
-	case c.dataCh <- samples:
-	default:
-	}
-	return nil
-}
-
-func (c *Client) ReceiveAudio() ([]byte, error) {
-	if c.decodeCh == nil {
-		return nil, fmt.Errorf("client not initialized")
-	}
-	pcm := <-c.decodeCh
-	out := make([]byte, len(pcm)*2)
-	for i, v := range pcm {
-		out[2*i] = byte(v)
-		out[2*i+1] = byte(v >> 8)
-	}
-	return out, nil
-}
+package matrixdll
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	_ "golang.org/x/mobile/bind"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	sampleRate   = 48000
+	channels     = 1
+	frameSize    = 960
+	opusBufSize  = 4000
+	syncRetryGap = time.Second
+
+	// defaultCallLifetime is the MSC2746 invite/negotiate lifetime in milliseconds.
+	defaultCallLifetime = 60000
+)
+
+type Client struct {
+	homeserver    string
+	username      string
+	password      string
+	roomID        string
+	mautrixClient *mautrix.Client
+	pc            *webrtc.PeerConnection
+
+	mu            sync.Mutex
+	callState     CallState
+	currentCallID string
+	myPartyID     string
+	remotePartyID string
+	myUserID      id.UserID
+	myDeviceID    id.DeviceID
+	inviteTimer   *time.Timer
+	listener      CallListener
+
+	// callDone is closed by endCallLocked when the current call's lifetime
+	// ends (by StartCall tearing down the previous one, or by Hangup), to
+	// stop the encode goroutine and runStatsLoop started for it. nil
+	// whenever no call has been started yet.
+	callDone chan struct{}
+	// sendSender is the RTPSender for the current call's local audio track,
+	// so the next StartCall can RemoveTrack it instead of leaving it on pc
+	// and offering a second audio m-line alongside the new one.
+	sendSender *webrtc.RTPSender
+	// syncOnce ensures the mautrix sync loop is only started once per
+	// Client, no matter how many calls StartCall places over its lifetime.
+	syncOnce sync.Once
+
+	// opusConfig is used whenever Opus is selected, either as our initial
+	// send codec or as the codec for a remote track.
+	opusConfig OpusConfig
+	// sendCodec encodes outgoing PCM; it starts out as Opus and is
+	// replaced once we see which codec the remote actually answered with.
+	sendCodec Codec
+	// appSampleRate is the PCM rate SendAudio/ReceiveAudio exchange with
+	// the app; it's resampled to/from whatever the active codec expects.
+	appSampleRate uint32
+
+	// stats is refreshed periodically by runStatsLoop from pc.GetStats().
+	stats CallStats
+	// bitrateBps is the adaptive target passed to the send codec; it's set
+	// by runStatsLoop from bwe's estimate.
+	bitrateBps int
+	// bwe is the GCC bandwidth estimator newWebRTCAPI wires into the send
+	// path's RTCP/RTP interceptor chain; runStatsLoop reads its target
+	// bitrate instead of deriving one from raw loss itself. Set once, right
+	// after NewPeerConnection returns, never reassigned after that.
+	bwe cc.BandwidthEstimator
+
+	// encryptedCall is set by EnableEncryption. When true, call signaling
+	// goes over to-device events encrypted per-recipient-device instead of
+	// plaintext room events, and sframe wraps outgoing/incoming Opus frames.
+	encryptedCall bool
+	// boxPriv/boxPub are this device's X25519 keypair, generated by
+	// EnableEncryption and published via UploadKeys; sendCallEvent derives a
+	// per-device shared secret from them via ECDH. See encrypted_call.go.
+	boxPriv [32]byte
+	boxPub  [32]byte
+	// signPriv/signPub are this device's Ed25519 identity keypair, generated
+	// alongside boxPriv/boxPub. EnableEncryption signs boxPub with signPriv
+	// before uploading both, and remoteDeviceKeys verifies the same
+	// signature on the other party's keys, so a homeserver can't substitute
+	// its own curve25519 key for a device's without the swap being detected.
+	signPriv ed25519.PrivateKey
+	signPub  ed25519.PublicKey
+	sframe   *sframeCipher
+	// remoteUserID is the other party's Matrix user ID, needed to address
+	// to-device messages in EncryptedCall mode. Room events don't need it;
+	// it's left empty whenever encryptedCall is false.
+	remoteUserID id.UserID
+	// remoteDeviceKeyCache holds the result of the first /keys/query lookup
+	// for remoteUserID, so sendCallEvent doesn't re-fetch device keys for
+	// every trickled ICE candidate. A call's device set doesn't change
+	// mid-call, so there's no invalidation; it's reset by discoverRemoteUser
+	// at the start of the next call.
+	remoteDeviceKeyCache map[id.DeviceID][]byte
+
+	dataCh   chan []int16
+	decodeCh chan []int16
+}
+
+// iceServers returns the STUN/TURN configuration shared by every
+// PeerConnection the package creates, whether for a 1:1 Client or for the
+// per-participant peers of a GroupCall.
+func iceServers() []webrtc.ICEServer {
+	return []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.l.google.com:19302"}},
+		{URLs: []string{"turn:webqalqan.com:3478"}, Username: "turnuser", Credential: "turnpass"},
+	}
+}
+
+// newWebRTCAPI builds a pion webrtc.API with this package's supported audio
+// codec set, the default RTCP interceptors (NACK generation/response,
+// sender/receiver reports, TWCC), the TWCC header extension sender (so our
+// outgoing packets carry the transport-wide sequence numbers TWCC feedback
+// is keyed on), and a GCC bandwidth estimator wired into the send path.
+// Shared by Client and GroupCall so every PeerConnection in the package
+// negotiates the same codecs and feedback. onBWE, if non-nil, is called once
+// per PeerConnection built from the returned API with that connection's
+// bandwidth estimator.
+func newWebRTCAPI(onBWE func(cc.BandwidthEstimator)) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := registerAudioCodecs(mediaEngine); err != nil {
+		return nil, fmt.Errorf("register audio codecs: %w", err)
+	}
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, fmt.Errorf("RegisterDefaultInterceptors: %w", err)
+	}
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptorRegistry); err != nil {
+		return nil, fmt.Errorf("ConfigureTWCCHeaderExtensionSender: %w", err)
+	}
+	ccFactory, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEMinBitrate(minAdaptiveBitrate),
+			gcc.SendSideBWEMaxBitrate(maxAdaptiveBitrate),
+		)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cc.NewInterceptor: %w", err)
+	}
+	if onBWE != nil {
+		ccFactory.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+			onBWE(estimator)
+		})
+	}
+	interceptorRegistry.Add(ccFactory)
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+	), nil
+}
+
+// registerAudioCodecs registers the audio codecs this package actually
+// implements a Codec for: Opus, PCMU and PCMA. It deliberately doesn't call
+// MediaEngine.RegisterDefaultCodecs, which also registers G.722 and a full
+// set of video codecs this package has no use for — offering a codec we
+// have no interoperable encoder/decoder for would let a remote party
+// negotiate it and get noise instead of audio.
+func registerAudioCodecs(m *webrtc.MediaEngine) error {
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+			PayloadType:        111,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+			PayloadType:        0,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+			PayloadType:        8,
+		},
+	} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewClient(homeserver, username, password, roomID string) (*Client, error) {
+	c := &Client{
+		homeserver:    homeserver,
+		username:      username,
+		password:      password,
+		roomID:        roomID,
+		appSampleRate: sampleRate,
+		dataCh:        make(chan []int16, 50),
+		decodeCh:      make(chan []int16, 50),
+	}
+
+	mcl, err := mautrix.NewClient(c.homeserver, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("mautrix NewClient: %w", err)
+	}
+	resp, err := mcl.Login(context.Background(), &mautrix.ReqLogin{
+		Type:       "m.login.password",
+		Identifier: mautrix.UserIdentifier{Type: "m.id.user", User: c.username},
+		Password:   c.password,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("login error: %w", err)
+	}
+	mcl.SetCredentials(resp.UserID, resp.AccessToken)
+	c.mautrixClient = mcl
+	c.myUserID = resp.UserID
+	c.myDeviceID = resp.DeviceID
+	c.myPartyID = uuid.NewString()
+
+	conf := webrtc.Configuration{
+		ICETransportPolicy: webrtc.ICETransportPolicyAll,
+		ICEServers:         iceServers(),
+	}
+	api, err := newWebRTCAPI(func(estimator cc.BandwidthEstimator) {
+		c.mu.Lock()
+		c.bwe = estimator
+		c.mu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+	pc, err := api.NewPeerConnection(conf)
+	if err != nil {
+		return nil, fmt.Errorf("NewPeerConnection: %w", err)
+	}
+
+	pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
+		var candJSON map[string]interface{}
+		if cand == nil {
+			// nil marks the end of this gathering pass; trickle it to the
+			// remote peer as an empty candidate per MSC2746.
+			candJSON = map[string]interface{}{"candidate": "", "sdpMid": "", "sdpMLineIndex": 0}
+		} else {
+			ice := cand.ToJSON()
+			candJSON = map[string]interface{}{
+				"candidate":     ice.Candidate,
+				"sdpMid":        ice.SDPMid,
+				"sdpMLineIndex": ice.SDPMLineIndex,
+			}
+		}
+		c.mu.Lock()
+		callID := c.currentCallID
+		c.mu.Unlock()
+		payload := map[string]interface{}{
+			"call_id":    callID,
+			"party_id":   c.myPartyID,
+			"version":    "1",
+			"candidates": []interface{}{candJSON},
+		}
+		if err := c.sendCallEvent(context.Background(), event.CallCandidates, payload); err != nil {
+			log.Println("Send ICE candidate error:", err)
+		}
+	})
+
+	// Log state changes
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Println("PeerConnection state:", state)
+	})
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Println("ICE connection state:", state)
+	})
+
+	// Incoming audio handler: picks the Codec matching whatever the remote
+	// is actually sending rather than assuming Opus.
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeAudio {
+			return
+		}
+		go drainReceiverRTCP(receiver)
+		c.mu.Lock()
+		opusCfg := c.opusConfig
+		c.mu.Unlock()
+		go startTrackReader(track, opusCfg, func() uint32 {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.appSampleRate
+		}, c.decodeCh, c.sframeDecryptFunc())
+	})
+
+	c.pc = pc
+
+	if syncer, ok := c.mautrixClient.Syncer.(*mautrix.DefaultSyncer); ok {
+		syncer.OnEventType(event.CallInvite, c.handleCallInvite)
+		syncer.OnEventType(event.CallAnswer, c.handleCallAnswer)
+		syncer.OnEventType(event.CallSelectAnswer, c.handleCallSelectAnswer)
+		syncer.OnEventType(event.CallNegotiate, c.handleCallNegotiate)
+		syncer.OnEventType(event.CallHangup, c.handleCallHangup)
+		syncer.OnEventType(event.CallReject, c.handleCallReject)
+		syncer.OnEventType(event.CallCandidates, c.handleCallCandidates)
+	}
+
+	return c, nil
+}
+
+// endCallLocked stops the current call's encode goroutine and runStatsLoop
+// (by closing callDone) and returns the RTPSender for its local track, if
+// any, so the caller can RemoveTrack it from pc once c.mu is released.
+// Callers must hold c.mu.
+func (c *Client) endCallLocked() *webrtc.RTPSender {
+	if c.callDone != nil {
+		close(c.callDone)
+		c.callDone = nil
+	}
+	sender := c.sendSender
+	c.sendSender = nil
+	return sender
+}
+
+// StartCall places a new call, sending an m.call.invite to the room (or, in
+// EncryptedCall mode, to the other party's devices directly). c is reusable
+// across calls: once the previous call has ended (Hangup, remote hangup,
+// glare loss, timeout, ...), StartCall tears down its local track and
+// background goroutines before starting the new one. It returns an error if
+// a call is already in progress.
+func (c *Client) StartCall() error {
+	c.mu.Lock()
+	if c.callState != CallStateIdle && c.callState != CallStateEnded {
+		c.mu.Unlock()
+		return fmt.Errorf("a call is already in progress")
+	}
+	prevSender := c.endCallLocked()
+	encryptedCall := c.encryptedCall
+	c.mu.Unlock()
+	if prevSender != nil {
+		if err := c.pc.RemoveTrack(prevSender); err != nil {
+			log.Println("remove previous send track error:", err)
+		}
+	}
+	if encryptedCall {
+		// Candidates trickle as soon as BuildOfferSDP below sets the local
+		// description, so the remote party must be known before that point.
+		if err := c.discoverRemoteUser(); err != nil {
+			return fmt.Errorf("discover remote user: %w", err)
+		}
+	}
+
+	// The wire format of the local track is fixed at creation time, so we
+	// start out offering Opus; handleCallAnswer swaps c.sendCodec to
+	// whatever the remote actually negotiated for any codec decisions made
+	// after that point (e.g. a future Negotiate() call).
+	initialCodec, err := NewOpusCodec(c.opusConfig)
+	if err != nil {
+		return fmt.Errorf("build initial codec: %w", err)
+	}
+	c.mu.Lock()
+	c.sendCodec = initialCodec
+	c.mu.Unlock()
+
+	sendTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: initialCodec.MimeType(), ClockRate: initialCodec.ClockRate(), Channels: initialCodec.Channels()},
+		"matrix-send", "audio",
+	)
+	if err != nil {
+		return fmt.Errorf("create send track: %w", err)
+	}
+	sender, err := c.pc.AddTrack(sendTrack)
+	if err != nil {
+		return fmt.Errorf("add send track: %w", err)
+	}
+	go drainSenderRTCP(sender)
+
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.sendSender = sender
+	c.callDone = done
+	c.mu.Unlock()
+	go c.runStatsLoop(done)
+
+	// startEncodeLoop is called either once pc transitions to Connected, or
+	// immediately below if pc is already Connected because this is a repeat
+	// call on a Client whose connection never dropped between calls -
+	// OnConnectionStateChange only fires on a transition, so without this
+	// check that case would never start an encode goroutine for the new
+	// call at all. The sync.Once makes it safe to call from both places.
+	var startEncodeOnce sync.Once
+	startEncodeLoop := func() {
+		startEncodeOnce.Do(func() {
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					case pcm := <-c.dataCh:
+						c.mu.Lock()
+						codec := c.sendCodec
+						appRate := c.appSampleRate
+						c.mu.Unlock()
+						if appRate != codec.SampleRate() {
+							pcm = resamplePCM(pcm, appRate, codec.SampleRate(), codec.Channels())
+						}
+						pkt, err := codec.Encode(pcm)
+						if err != nil {
+							log.Println("encode error:", err)
+							continue
+						}
+						if len(pkt) == 0 {
+							continue // DTX: this frame was silence
+						}
+						if sframe := c.sframeEncryptFunc(); sframe != nil {
+							pkt, err = sframe(pkt)
+							if err != nil {
+								log.Println("sframe encrypt error:", err)
+								continue
+							}
+						}
+						if err := sendTrack.WriteSample(media.Sample{Data: pkt, Duration: codec.PTime()}); err != nil {
+							log.Println("WriteSample error:", err)
+						}
+					}
+				}
+			}()
+		})
+	}
+	c.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			startEncodeLoop()
+		}
+	})
+	if c.pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+		startEncodeLoop()
+	}
+
+	c.syncOnce.Do(func() {
+		go func() {
+			for {
+				if err := c.mautrixClient.Sync(); err != nil {
+					log.Println("Sync error:", err)
+					time.Sleep(syncRetryGap)
+				}
+			}
+		}()
+	})
+
+	c.mu.Lock()
+	c.currentCallID = fmt.Sprintf("call-%d", time.Now().Unix())
+	c.callState = CallStateInviteSent
+	c.mu.Unlock()
+
+	sdp, err := BuildOfferSDP(c.pc)
+	if err != nil {
+		return fmt.Errorf("BuildOfferSDP error: %w", err)
+	}
+	invite := map[string]interface{}{
+		"call_id":  c.currentCallID,
+		"lifetime": defaultCallLifetime,
+		"offer":    map[string]interface{}{"type": "offer", "sdp": sdp},
+		"version":  "1",
+		"party_id": c.myPartyID,
+	}
+	if encryptedCall {
+		c.mu.Lock()
+		secret := c.sframe.Secret()
+		c.mu.Unlock()
+		invite[sframeKeyField] = base64.StdEncoding.EncodeToString(secret)
+	}
+	if err := c.sendCallEvent(context.Background(), event.CallInvite, invite); err != nil {
+		return fmt.Errorf("send invite: %w", err)
+	}
+
+	c.mu.Lock()
+	c.startInviteTimerLocked(defaultCallLifetime)
+	c.mu.Unlock()
+	return nil
+}
+
+// BuildOfferSDP creates and sets the local offer, then returns its SDP
+// immediately instead of waiting for ICE gathering to finish. Candidates
+// are trickled separately via pc.OnICECandidate as they're discovered.
+func BuildOfferSDP(pc *webrtc.PeerConnection) (string, error) {
+	off, err := pc.CreateOffer(nil)
+	if err != nil {
+		return "", fmt.Errorf("CreateOffer error: %w", err)
+	}
+	if err := pc.SetLocalDescription(off); err != nil {
+		return "", fmt.Errorf("SetLocalDescription error: %w", err)
+	}
+	return off.SDP, nil
+}
+
+// SetOpusConfig configures Opus encode/decode parameters (stereo, bitrate,
+// FEC, DTX). Call it before StartCall; it has no effect on a call already
+// in progress.
+func (c *Client) SetOpusConfig(cfg OpusConfig) {
+	c.mu.Lock()
+	c.opusConfig = cfg
+	c.mu.Unlock()
+}
+
+// SetAudioSampleRate tells the client what PCM rate the app uses with
+// SendAudio/ReceiveAudio. The client resamples to/from whatever the active
+// codec expects. Defaults to 48000.
+func (c *Client) SetAudioSampleRate(rate uint32) {
+	c.mu.Lock()
+	c.appSampleRate = rate
+	c.mu.Unlock()
+}
+
+func (c *Client) SendAudio(data []byte) error {
+	if c.dataCh == nil {
+		return fmt.Errorf("client not initialized")
+	}
+	n := len(data) / 2
+	samples := make([]int16, n)
+	for i := 0; i < n; i++ {
+		samples[i] = int16(data[2*i]) | int16(data[2*i+1])<<8
+	}
+	select {
+	case c.dataCh <- samples:
+	default:
+	}
+	return nil
+}
+
+func (c *Client) ReceiveAudio() ([]byte, error) {
+	if c.decodeCh == nil {
+		return nil, fmt.Errorf("client not initialized")
+	}
+	pcm := <-c.decodeCh
+	out := make([]byte, len(pcm)*2)
+	for i, v := range pcm {
+		out[2*i] = byte(v)
+		out[2*i+1] = byte(v >> 8)
+	}
+	return out, nil
+}
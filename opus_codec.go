@@ -0,0 +1,90 @@
+package matrixdll
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"layeh.com/gopus"
+)
+
+// OpusConfig configures an OpusCodec.
+type OpusConfig struct {
+	// Stereo encodes/decodes 2 channels instead of mono.
+	Stereo bool
+	// Bitrate in bits per second. Zero keeps gopus's default (VBR).
+	Bitrate int
+	// FEC requests that lost-packet recovery be attempted on decode using
+	// the in-band forward error correction data Opus may have included.
+	// gopus doesn't expose OPUS_SET_INBAND_FEC, so this only affects how we
+	// call Decode; the encoder side can't be told to embed FEC data.
+	FEC bool
+	// DTX suppresses sending encoded silence; Encode returns a zero-length
+	// payload for silent frames so the caller can skip the packet. gopus
+	// doesn't expose OPUS_SET_DTX, so this is done on our side.
+	DTX bool
+}
+
+// OpusCodec implements Codec using layeh.com/gopus.
+type OpusCodec struct {
+	cfg      OpusConfig
+	channels int
+	enc      *gopus.Encoder
+	dec      *gopus.Decoder
+}
+
+// NewOpusCodec builds an Opus codec at the standard 48 kHz clock rate.
+func NewOpusCodec(cfg OpusConfig) (*OpusCodec, error) {
+	ch := 1
+	if cfg.Stereo {
+		ch = 2
+	}
+	enc, err := gopus.NewEncoder(sampleRate, ch, gopus.Voip)
+	if err != nil {
+		return nil, fmt.Errorf("gopus encoder: %w", err)
+	}
+	if cfg.Bitrate > 0 {
+		enc.SetBitrate(cfg.Bitrate)
+	}
+	dec, err := gopus.NewDecoder(sampleRate, ch)
+	if err != nil {
+		return nil, fmt.Errorf("gopus decoder: %w", err)
+	}
+	return &OpusCodec{cfg: cfg, channels: ch, enc: enc, dec: dec}, nil
+}
+
+func (c *OpusCodec) Encode(pcm []int16) ([]byte, error) {
+	if c.cfg.DTX && isSilence(pcm) {
+		return nil, nil
+	}
+	return c.enc.Encode(pcm, frameSize, opusBufSize)
+}
+
+func (c *OpusCodec) Decode(payload []byte) ([]int16, error) {
+	if len(payload) == 0 {
+		// DTX: the remote sent nothing for this frame.
+		return nil, nil
+	}
+	return c.dec.Decode(payload, frameSize, c.cfg.FEC)
+}
+
+// SetBitrate changes the encoder's target bitrate on the fly. Used by
+// Client's adaptive bitrate loop to react to RTCP loss feedback.
+func (c *OpusCodec) SetBitrate(bps int) {
+	c.enc.SetBitrate(bps)
+}
+
+func (c *OpusCodec) MimeType() string     { return webrtc.MimeTypeOpus }
+func (c *OpusCodec) ClockRate() uint32    { return sampleRate }
+func (c *OpusCodec) SampleRate() uint32   { return sampleRate }
+func (c *OpusCodec) Channels() uint16     { return uint16(c.channels) }
+func (c *OpusCodec) PTime() time.Duration { return 20 * time.Millisecond }
+
+func isSilence(pcm []int16) bool {
+	for _, s := range pcm {
+		if s != 0 {
+			return false
+		}
+	}
+	return true
+}
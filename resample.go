@@ -0,0 +1,32 @@
+package matrixdll
+
+// resamplePCM converts interleaved pcm sampled at fromRate to toRate using
+// linear interpolation, treating it as channels-many independently
+// interleaved streams so stereo audio doesn't blend across channel
+// boundaries. It's good enough for voice; it's not used for music.
+func resamplePCM(pcm []int16, fromRate, toRate uint32, channels uint16) []int16 {
+	if fromRate == toRate || len(pcm) == 0 || channels == 0 {
+		return pcm
+	}
+	frames := len(pcm) / int(channels)
+	outFrames := int(uint64(frames) * uint64(toRate) / uint64(fromRate))
+	if outFrames <= 0 {
+		return nil
+	}
+	out := make([]int16, outFrames*int(channels))
+	ratio := float64(fromRate) / float64(toRate)
+	for i := 0; i < outFrames; i++ {
+		srcPos := float64(i) * ratio
+		idx := int(srcPos)
+		frac := srcPos - float64(idx)
+		for ch := 0; ch < int(channels); ch++ {
+			a := pcm[idx*int(channels)+ch]
+			b := a
+			if idx+1 < frames {
+				b = pcm[(idx+1)*int(channels)+ch]
+			}
+			out[i*int(channels)+ch] = int16(float64(a) + (float64(b)-float64(a))*frac)
+		}
+	}
+	return out
+}
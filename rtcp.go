@@ -0,0 +1,161 @@
+package matrixdll
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// drainSenderRTCP reads and discards RTCP feedback (NACK, receiver reports,
+// TWCC) arriving for an outgoing track. pion queues incoming RTCP until
+// something calls ReadRTCP; without a reader it backs up and the
+// interceptors that compute loss/RTT stop getting fed. Returns once sender
+// is closed.
+func drainSenderRTCP(sender *webrtc.RTPSender) {
+	for {
+		if _, _, err := sender.ReadRTCP(); err != nil {
+			return
+		}
+	}
+}
+
+// drainReceiverRTCP is the receive-side counterpart of drainSenderRTCP, for
+// the RTCP (mostly sender reports) pion delivers alongside an incoming
+// track.
+func drainReceiverRTCP(receiver *webrtc.RTPReceiver) {
+	for {
+		if _, _, err := receiver.ReadRTCP(); err != nil {
+			return
+		}
+	}
+}
+
+// CallStats summarizes the current call's network quality, sampled from
+// pc.GetStats(). All fields read zero until the first sample after the
+// PeerConnection starts exchanging RTCP reports.
+type CallStats struct {
+	JitterMS   float64
+	PacketLoss float64 // fraction of packets lost, 0-1
+	RTTMS      float64
+	BitrateBps int // measured outgoing audio bitrate over the last sample window
+}
+
+// Stats returns the most recently sampled call statistics.
+func (c *Client) Stats() CallStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// BitrateAdjustable is implemented by codecs whose encoder bitrate can be
+// changed on the fly. Only OpusCodec does today; G.711 has no variable
+// bitrate to adjust, so runStatsLoop leaves it alone.
+type BitrateAdjustable interface {
+	SetBitrate(bps int)
+}
+
+const (
+	statsSampleInterval = 2 * time.Second
+	minAdaptiveBitrate  = 8000
+	maxAdaptiveBitrate  = 64000
+	lossHighWatermark   = 0.1  // back off the bitrate above this loss fraction
+	lossLowWatermark    = 0.02 // climb back up below this loss fraction
+)
+
+// runStatsLoop periodically samples pc.GetStats() into c.stats and, when the
+// active send codec supports it, adapts its bitrate so the call degrades
+// gracefully instead of only shedding samples once the network can't keep
+// up. newWebRTCAPI wires a GCC send-side bandwidth estimator (pion/interceptor's
+// pkg/gcc, fed by TWCC feedback) into c.bwe; when one is present its target
+// bitrate drives the adaptation. c.bwe is nil for GroupCall's peer
+// connections, which don't wire an estimator, so this also falls back to a
+// simple AIMD on the loss fraction RTCP receiver reports give us, for those
+// and for any call made before the estimator has produced its first target.
+// It runs until done is closed, which StartCall's next call (or Hangup)
+// does via endCallLocked so this doesn't leak a goroutine per call.
+func (c *Client) runStatsLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(statsSampleInterval)
+	defer ticker.Stop()
+
+	var lastBytesSent uint64
+	var lastSampleAt time.Time
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		report := c.pc.GetStats()
+		var stats CallStats
+		var bytesSent uint64
+		now := time.Now()
+		for _, s := range report {
+			switch v := s.(type) {
+			case webrtc.RemoteInboundRTPStreamStats:
+				if v.Kind == "audio" {
+					stats.JitterMS = v.Jitter * 1000
+					stats.PacketLoss = v.FractionLost
+					stats.RTTMS = v.RoundTripTime * 1000
+				}
+			case webrtc.OutboundRTPStreamStats:
+				if v.Kind == "audio" {
+					bytesSent = v.BytesSent
+				}
+			}
+		}
+		if !lastSampleAt.IsZero() && bytesSent >= lastBytesSent {
+			if elapsed := now.Sub(lastSampleAt).Seconds(); elapsed > 0 {
+				stats.BitrateBps = int(float64(bytesSent-lastBytesSent) * 8 / elapsed)
+			}
+		}
+		lastBytesSent = bytesSent
+		lastSampleAt = now
+
+		c.mu.Lock()
+		c.stats = stats
+		codec := c.sendCodec
+		bwe := c.bwe
+		ceiling := c.opusConfig.Bitrate
+		if ceiling <= 0 {
+			ceiling = maxAdaptiveBitrate
+		}
+		if c.bitrateBps == 0 {
+			c.bitrateBps = ceiling
+		}
+		if bwe != nil {
+			c.bitrateBps = clampInt(bwe.GetTargetBitrate(), minAdaptiveBitrate, ceiling)
+		} else {
+			switch {
+			case stats.PacketLoss > lossHighWatermark:
+				c.bitrateBps = maxInt(minAdaptiveBitrate, c.bitrateBps*8/10)
+			case stats.PacketLoss < lossLowWatermark:
+				c.bitrateBps = minInt(ceiling, c.bitrateBps*11/10)
+			}
+		}
+		target := c.bitrateBps
+		c.mu.Unlock()
+
+		if adjustable, ok := codec.(BitrateAdjustable); ok {
+			adjustable.SetBitrate(target)
+		}
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func clampInt(v, lo, hi int) int {
+	return maxInt(lo, minInt(v, hi))
+}
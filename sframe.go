@@ -0,0 +1,232 @@
+package matrixdll
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sframeSenderTagSize is the length of the random tag each sframeCipher
+// instance picks for itself at creation. It's folded into key derivation so
+// that, even though both parties in a call share the same secret, their
+// send keys differ — without it, two independently-incrementing counters
+// starting at 0 would reuse the same (key, nonce) pair for the first frame
+// of each direction, breaking AES-GCM.
+const sframeSenderTagSize = 4
+
+// sframeHeaderSize is the length of the header Encrypt prepends to every
+// frame: a 4-byte key generation, the 4-byte sender tag, and an 8-byte
+// counter. Together they double as the 16-byte AES-GCM nonce, so no
+// separate nonce needs to be negotiated or carried alongside the ciphertext.
+const sframeHeaderSize = 4 + sframeSenderTagSize + 8
+
+// sframeKeyInfo namespaces the HKDF expand step so a generation's derived
+// key can't collide with some other use of the same shared secret.
+const sframeKeyInfo = "matrixdll-sframe"
+
+// sframeCipher implements SFrame-style per-frame media encryption: outgoing
+// Opus frames are wrapped in AES-GCM using a key derived from a shared
+// secret exchanged out of band (carried in the m.call.invite payload) plus
+// this instance's own sender tag, and inbound frames are decrypted by
+// re-deriving whatever (generation, sender tag) pair their header names.
+// Rotate advances to a new key generation; frames from just before a
+// rotation still decrypt because Decrypt derives whatever generation the
+// frame's header names.
+// sframeReplayWindowSize is how many of the most recent counters per sender
+// Decrypt remembers, as a bitmap trailing replayHighest. A frame whose
+// counter falls inside the window and is already marked is a replay; one
+// that falls behind the window entirely is treated as too old and rejected
+// the same way, since gopus/Opus can't meaningfully use audio that stale.
+const sframeReplayWindowSize = 64
+
+// replayState is the per-(generation, sender tag) replay-detection state
+// Decrypt keeps alongside the derived AEAD: the highest counter accepted so
+// far and a bitmap of which of the sframeReplayWindowSize counters below it
+// have already been seen.
+type replayState struct {
+	aead    cipher.AEAD
+	highest uint64
+	seen    uint64
+	started bool
+}
+
+type sframeCipher struct {
+	mu        sync.Mutex
+	secret    []byte
+	sendTag   [sframeSenderTagSize]byte
+	sendGen   uint32
+	sendCtr   uint64
+	sendAEAD  cipher.AEAD
+	recvState map[[4 + sframeSenderTagSize]byte]*replayState
+}
+
+// newSFrameCipher derives generation 0's send key from secret, the shared
+// secret exchanged in the call invite, and a freshly-generated sender tag
+// that distinguishes this instance's outgoing frames from the other
+// party's, which derives its own tag independently from the same secret.
+func newSFrameCipher(secret []byte) (*sframeCipher, error) {
+	var tag [sframeSenderTagSize]byte
+	if _, err := rand.Read(tag[:]); err != nil {
+		return nil, fmt.Errorf("generate sframe sender tag: %w", err)
+	}
+	c := &sframeCipher{secret: secret, sendTag: tag, recvState: make(map[[4 + sframeSenderTagSize]byte]*replayState)}
+	aead, err := deriveSFrameAEAD(secret, 0, tag)
+	if err != nil {
+		return nil, err
+	}
+	c.sendAEAD = aead
+	return c, nil
+}
+
+// deriveSFrameAEAD derives the AES-256-GCM key for generation gen and sender
+// tag senderTag from secret via HKDF-SHA256. Mixing senderTag into the info
+// string, rather than just gen, is what keeps the two directions of a call
+// from ever encrypting under the same key.
+func deriveSFrameAEAD(secret []byte, gen uint32, senderTag [sframeSenderTagSize]byte) (cipher.AEAD, error) {
+	info := make([]byte, len(sframeKeyInfo)+4+sframeSenderTagSize)
+	n := copy(info, sframeKeyInfo)
+	binary.BigEndian.PutUint32(info[n:], gen)
+	copy(info[n+4:], senderTag[:])
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key); err != nil {
+		return nil, fmt.Errorf("derive sframe key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("sframe aes cipher: %w", err)
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, sframeHeaderSize)
+	if err != nil {
+		return nil, fmt.Errorf("sframe gcm: %w", err)
+	}
+	return aead, nil
+}
+
+// Rotate advances the send generation to one derived from secret, picking a
+// fresh sender tag along with it. Callers should invoke it on membership
+// change (a participant joining or leaving) so a departed participant's key
+// stops being usable for new frames; this is unused by today's 1:1-only
+// EncryptedCall but kept as the hook GroupCall will call into once group
+// calls support encryption.
+func (c *sframeCipher) Rotate(secret []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var tag [sframeSenderTagSize]byte
+	if _, err := rand.Read(tag[:]); err != nil {
+		return fmt.Errorf("generate sframe sender tag: %w", err)
+	}
+	gen := c.sendGen + 1
+	aead, err := deriveSFrameAEAD(secret, gen, tag)
+	if err != nil {
+		return err
+	}
+	c.secret = secret
+	c.sendTag = tag
+	c.sendGen = gen
+	c.sendCtr = 0
+	c.sendAEAD = aead
+	return nil
+}
+
+// Secret returns the shared secret the current generation's key is derived
+// from, so it can be carried to the other party in an invite.
+func (c *sframeCipher) Secret() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.secret
+}
+
+// Encrypt wraps plaintext (an encoded Opus frame) with the current send
+// generation's key, prefixing the ciphertext with the header that also
+// serves as the AEAD nonce.
+func (c *sframeCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := make([]byte, sframeHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], c.sendGen)
+	copy(header[4:4+sframeSenderTagSize], c.sendTag[:])
+	binary.BigEndian.PutUint64(header[4+sframeSenderTagSize:], c.sendCtr)
+	c.sendCtr++
+	return c.sendAEAD.Seal(header, header, plaintext, nil), nil
+}
+
+// Decrypt reverses Encrypt, deriving (and caching) the key for whatever
+// (generation, sender tag) pair the frame's header names, and rejects any
+// frame whose counter has already been seen from that sender.
+func (c *sframeCipher) Decrypt(frame []byte) ([]byte, error) {
+	if len(frame) < sframeHeaderSize {
+		return nil, fmt.Errorf("sframe: frame too short")
+	}
+	header := frame[:sframeHeaderSize]
+	gen := binary.BigEndian.Uint32(header[0:4])
+	var recvKey [4 + sframeSenderTagSize]byte
+	copy(recvKey[:], header[:4+sframeSenderTagSize])
+	var senderTag [sframeSenderTagSize]byte
+	copy(senderTag[:], header[4:4+sframeSenderTagSize])
+	ctr := binary.BigEndian.Uint64(header[4+sframeSenderTagSize:])
+
+	c.mu.Lock()
+	state, ok := c.recvState[recvKey]
+	if !ok {
+		aead, err := deriveSFrameAEAD(c.secret, gen, senderTag)
+		if err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		state = &replayState{aead: aead}
+		c.recvState[recvKey] = state
+	}
+	if replay := state.checkAndMark(ctr); replay {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("sframe: replayed or stale frame (counter %d)", ctr)
+	}
+	aead := state.aead
+	c.mu.Unlock()
+
+	return aead.Open(nil, header, frame[sframeHeaderSize:], nil)
+}
+
+// checkAndMark reports whether ctr is a replay (already marked seen, or too
+// far behind the window to tell) and, if not, marks it seen and slides the
+// window forward when ctr is a new high.
+func (s *replayState) checkAndMark(ctr uint64) (replay bool) {
+	if !s.started {
+		s.started = true
+		s.highest = ctr
+		s.seen = 1
+		return false
+	}
+	switch {
+	case ctr > s.highest:
+		shift := ctr - s.highest
+		if shift >= sframeReplayWindowSize {
+			s.seen = 0
+		} else {
+			s.seen <<= shift
+		}
+		s.seen |= 1
+		s.highest = ctr
+		return false
+	case ctr == s.highest:
+		return true
+	default:
+		back := s.highest - ctr
+		if back >= sframeReplayWindowSize {
+			return true
+		}
+		bit := uint64(1) << back
+		if s.seen&bit != 0 {
+			return true
+		}
+		s.seen |= bit
+		return false
+	}
+}